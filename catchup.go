@@ -0,0 +1,368 @@
+// Copyright (c) 2016 - Max Persson <max@looplab.se>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build mongo
+
+package eventhorizon
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrCouldNotAllocatePosition returned when a new event's global position
+// could not be allocated.
+var ErrCouldNotAllocatePosition = errors.New("could not allocate position")
+
+// pollInterval is how often a catch-up subscription looks for new events
+// once it has caught up, since mgo.v2 predates MongoDB change streams.
+const pollInterval = 1 * time.Second
+
+// Position identifies an event's place in the store's global, monotonically
+// increasing order, independent of any single aggregate's version. It is
+// used to resume a catch-up subscription from where it left off.
+type Position int64
+
+// PositionCheckpoint lets a catch-up subscriber persist the position it has
+// processed up to, so a projection can resume after a crash instead of
+// replaying the whole event history.
+type PositionCheckpoint interface {
+	// SavePosition persists position for subscriptionID.
+	SavePosition(subscriptionID string, position Position) error
+
+	// LoadPosition returns the last position saved for subscriptionID, or 0
+	// if none has been saved yet.
+	LoadPosition(subscriptionID string) (Position, error)
+}
+
+// MongoPositionCheckpoint is a PositionCheckpoint backed by a MongoDB
+// collection.
+type MongoPositionCheckpoint struct {
+	session *mgo.Session
+	db      string
+}
+
+// NewMongoPositionCheckpoint creates a MongoPositionCheckpoint using an
+// existing session.
+func NewMongoPositionCheckpoint(session *mgo.Session, database string) (*MongoPositionCheckpoint, error) {
+	if session == nil {
+		return nil, ErrNoDBSession
+	}
+
+	return &MongoPositionCheckpoint{session: session, db: database}, nil
+}
+
+type mongoCheckpointRecord struct {
+	SubscriptionID string   `bson:"_id"`
+	Position       Position `bson:"position"`
+}
+
+// SavePosition implements PositionCheckpoint.
+func (c *MongoPositionCheckpoint) SavePosition(subscriptionID string, position Position) error {
+	sess := c.session.Copy()
+	defer sess.Close()
+
+	_, err := sess.DB(c.db).C("checkpoints").UpsertId(subscriptionID, bson.M{
+		"$set": bson.M{"position": position},
+	})
+	if err != nil {
+		return ErrCouldNotSaveAggregate
+	}
+	return nil
+}
+
+// LoadPosition implements PositionCheckpoint.
+func (c *MongoPositionCheckpoint) LoadPosition(subscriptionID string) (Position, error) {
+	sess := c.session.Copy()
+	defer sess.Close()
+
+	var record mongoCheckpointRecord
+	err := sess.DB(c.db).C("checkpoints").FindId(subscriptionID).One(&record)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, ErrCouldNotLoadAggregate
+	}
+
+	return record.Position, nil
+}
+
+// EventStream delivers events read from the store in order over a channel.
+// Events is closed once every matching event has been sent, or Close is
+// called. Any read error is sent on Errors before Events is closed.
+type EventStream struct {
+	Events <-chan Event
+	Errors <-chan error
+
+	sess *mgo.Session
+	done chan bool
+}
+
+// Close stops the stream and releases its database session. Safe to call
+// even after the stream has drained on its own.
+func (es *EventStream) Close() {
+	select {
+	case <-es.done:
+	default:
+		close(es.done)
+	}
+	es.sess.Close()
+}
+
+// positionedEvent pairs a decoded event with the position it was stored at,
+// used internally to drive catch-up subscriptions.
+type positionedEvent struct {
+	event    Event
+	position Position
+}
+
+// nextPosition allocates the next value in the store's global, strictly
+// increasing event sequence, used to order and resume catch-up
+// subscriptions across aggregates.
+func (s *MongoEventStore) nextPosition(sess *mgo.Session) (Position, error) {
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+
+	var result struct {
+		Seq int64 `bson:"seq"`
+	}
+	if _, err := sess.DB(s.db).C("counters").FindId("events_position").Apply(change, &result); err != nil {
+		return 0, ErrCouldNotAllocatePosition
+	}
+
+	return Position(result.Seq), nil
+}
+
+// assignPositions allocates and stamps a position onto each of records, one
+// event at a time, matching each by its (already unique) version so the
+// single $set only ever touches the one event it was allocated for. Called
+// only after Save's append has already been durably written, so a position
+// is allocated for an event that is already guaranteed to exist.
+func (s *MongoEventStore) assignPositions(sess *mgo.Session, aggregateID string, records []*mongoEventRecord) error {
+	for _, r := range records {
+		position, err := s.nextPosition(sess)
+		if err != nil {
+			return err
+		}
+		r.Position = position
+
+		err = sess.DB(s.db).C("events").Update(
+			bson.M{"_id": aggregateID, "events.version": r.Version},
+			bson.M{"$set": bson.M{"events.$.position": position}},
+		)
+		if err != nil {
+			return ErrCouldNotSaveAggregate
+		}
+	}
+
+	return nil
+}
+
+// LoadAll returns an EventStream of every event with a timestamp at or
+// after sinceTimestamp, optionally filtered to eventTypes, in the order
+// they were stored. Pass a zero sinceTimestamp and a nil eventTypes to
+// replay the whole history, for example to rebuild a projection from
+// scratch.
+func (s *MongoEventStore) LoadAll(sinceTimestamp time.Time, eventTypes []string) (*EventStream, error) {
+	match := bson.M{"events.timestamp": bson.M{"$gte": sinceTimestamp}}
+	if len(eventTypes) > 0 {
+		match["events.type"] = bson.M{"$in": eventTypes}
+	}
+
+	sess, items, errs, done := s.streamMatching(match)
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for item := range items {
+			select {
+			case events <- item.event:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return &EventStream{Events: events, Errors: errs, sess: sess, done: done}, nil
+}
+
+// loadAllFrom streams every event with a position greater than
+// fromPosition, in position order, used to catch up a subscription.
+func (s *MongoEventStore) loadAllFrom(fromPosition Position) (sess *mgo.Session, items <-chan positionedEvent, errs <-chan error, done chan bool) {
+	return s.streamMatching(bson.M{"events.position": bson.M{"$gt": fromPosition}})
+}
+
+func (s *MongoEventStore) streamMatching(match bson.M) (sess *mgo.Session, items <-chan positionedEvent, errs <-chan error, done chan bool) {
+	sess = s.session.Copy()
+
+	pipe := sess.DB(s.db).C("events").Pipe([]bson.M{
+		{"$unwind": "$events"},
+		{"$match": match},
+		{"$sort": bson.M{"events.position": 1}},
+	})
+
+	itemsChan := make(chan positionedEvent)
+	errsChan := make(chan error, 1)
+	doneChan := make(chan bool)
+
+	go s.runStream(pipe.Iter(), itemsChan, errsChan, doneChan)
+
+	return sess, itemsChan, errsChan, doneChan
+}
+
+func (s *MongoEventStore) runStream(iter *mgo.Iter, items chan<- positionedEvent, errs chan<- error, done chan bool) {
+	defer close(items)
+
+	var wrapper struct {
+		Record mongoEventRecord `bson:"events"`
+	}
+	for iter.Next(&wrapper) {
+		event, err := s.decodeRecord(&wrapper.Record)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		select {
+		case items <- positionedEvent{event: event, position: wrapper.Record.Position}:
+		case <-done:
+			return
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		errs <- err
+	}
+}
+
+// decodeRecord decodes a stored event record into a concrete Event using
+// its registered factory and the codec it was written with.
+func (s *MongoEventStore) decodeRecord(record *mongoEventRecord) (Event, error) {
+	f, ok := s.factories[record.Type]
+	if !ok {
+		return nil, ErrEventNotRegistered
+	}
+
+	codec := s.codec
+	if record.ContentType != "" && record.ContentType != codec.ContentType() {
+		var err error
+		if codec, err = codecByContentType(record.ContentType); err != nil {
+			return nil, err
+		}
+	}
+
+	event := f()
+	if err := codec.Unmarshal(record.Data, event); err != nil {
+		return nil, ErrCouldNotUnmarshalEvent
+	}
+
+	decoded, ok := event.(Event)
+	if !ok {
+		return nil, ErrInvalidEvent
+	}
+
+	return decoded, nil
+}
+
+// MongoCatchupSubscription is a running SubscribeAll subscription. Call
+// Close to stop it.
+type MongoCatchupSubscription struct {
+	done chan bool
+}
+
+// Close stops the subscription's catch-up and polling loop.
+func (s *MongoCatchupSubscription) Close() {
+	close(s.done)
+}
+
+// SubscribeAll feeds handler every event from fromPosition onward, oldest
+// first and strictly in position order: it first catches up on events
+// already stored, then polls for new ones until Close is called. Positions
+// are allocated ahead of the write that uses them, so a later position can
+// become visible before an earlier one; SubscribeAll withholds anything
+// past such a gap until it closes, rather than skipping the missing event.
+// If checkpoint is non-nil, the position of the last event handled is saved
+// to it under subscriptionID after every event, so a restarted projection
+// can resume with checkpoint.LoadPosition instead of replaying from the
+// beginning.
+func (s *MongoEventStore) SubscribeAll(handler EventHandler, fromPosition Position, checkpoint PositionCheckpoint, subscriptionID string) (*MongoCatchupSubscription, error) {
+	sub := &MongoCatchupSubscription{done: make(chan bool)}
+
+	go s.runSubscription(handler, fromPosition, checkpoint, subscriptionID, sub)
+
+	return sub, nil
+}
+
+func (s *MongoEventStore) runSubscription(handler EventHandler, fromPosition Position, checkpoint PositionCheckpoint, subscriptionID string, sub *MongoCatchupSubscription) {
+	position := fromPosition
+
+	for {
+		sess, items, errs, streamDone := s.loadAllFrom(position)
+
+		drained := false
+		for !drained {
+			select {
+			case item, ok := <-items:
+				if !ok {
+					drained = true
+					break
+				}
+
+				// Position is allocated before it is stamped onto its
+				// (already written) event, so a later position can commit
+				// and be streamed before an earlier one. Only advance past positions we've
+				// seen contiguously from fromPosition: if this item isn't
+				// the very next one, stop here without checkpointing past
+				// the gap and retry the same range on the next poll, once
+				// the missing position has had a chance to commit.
+				if item.position != position+1 {
+					drained = true
+					break
+				}
+
+				if err := handler.HandleEvent(item.event); err != nil {
+					log.Printf("error: catch-up subscription: %v\n", err)
+				}
+				position = item.position
+				if checkpoint != nil {
+					if err := checkpoint.SavePosition(subscriptionID, position); err != nil {
+						log.Printf("error: catch-up subscription: %v\n", err)
+					}
+				}
+			case err := <-errs:
+				log.Printf("error: catch-up subscription: %v\n", err)
+				drained = true
+			case <-sub.done:
+				close(streamDone)
+				sess.Close()
+				return
+			}
+		}
+		close(streamDone)
+		sess.Close()
+
+		select {
+		case <-time.After(pollInterval):
+		case <-sub.done:
+			return
+		}
+	}
+}
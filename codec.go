@@ -0,0 +1,176 @@
+// Copyright (c) 2016 - Max Persson <max@looplab.se>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventhorizon
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrCouldNotMarshalEnvelope returned when an envelope could not be marshaled.
+var ErrCouldNotMarshalEnvelope = errors.New("could not marshal envelope")
+
+// ErrCouldNotUnmarshalEnvelope returned when an envelope could not be unmarshaled.
+var ErrCouldNotUnmarshalEnvelope = errors.New("could not unmarshal envelope")
+
+// ErrUnsupportedContentType returned when an envelope names a content type
+// that no registered codec can decode.
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// EventCodec marshals and unmarshals events to and from the wire format used
+// by an EventBus or EventStore. Implementations are swapped in so that the
+// same bus or store can be used by consumers that don't speak BSON, such as
+// non-Go services subscribing to Redis or Kafka.
+type EventCodec interface {
+	// Marshal encodes an event into its wire representation.
+	Marshal(event Event) ([]byte, error)
+
+	// Unmarshal decodes the wire representation into the given event.
+	Unmarshal(data []byte, event Event) error
+
+	// ContentType identifies the encoding used, and is carried on the
+	// envelope so that consumers can pick a matching codec.
+	ContentType() string
+}
+
+// EventEnvelope wraps an encoded event with the metadata needed to decode
+// and route it without first unmarshaling the payload, so that polyglot
+// consumers reading the same stream can negotiate on content type.
+//
+// Version is the aggregate version the event was written at. EventBus
+// implementations publish straight from an Event, which carries no version
+// of its own, so every bus-published envelope currently carries Version 0;
+// the field is kept on the wire so a future publisher with access to the
+// aggregate's version (for example the event store itself) can populate it
+// without changing the envelope schema consumers decode against.
+type EventEnvelope struct {
+	Type        string    `bson:"type" json:"type"`
+	Version     int       `bson:"version" json:"version"`
+	Timestamp   time.Time `bson:"timestamp" json:"timestamp"`
+	AggregateID string    `bson:"aggregate_id" json:"aggregate_id"`
+	ContentType string    `bson:"content_type" json:"content_type"`
+	Payload     []byte    `bson:"payload" json:"payload"`
+}
+
+// codecByContentType returns the built-in codec matching a content type
+// found on a received EventEnvelope, so a receiver can decode payloads from
+// publishers configured with a different codec than its own.
+func codecByContentType(contentType string) (EventCodec, error) {
+	switch contentType {
+	case (&BSONEventCodec{}).ContentType():
+		return &BSONEventCodec{}, nil
+	case (&JSONEventCodec{}).ContentType():
+		return &JSONEventCodec{}, nil
+	case (&ProtobufEventCodec{}).ContentType():
+		return &ProtobufEventCodec{}, nil
+	default:
+		return nil, ErrUnsupportedContentType
+	}
+}
+
+// BSONEventCodec marshals and unmarshals events as BSON, the format this
+// package has historically used on the wire.
+type BSONEventCodec struct{}
+
+// Marshal implements EventCodec.
+func (c *BSONEventCodec) Marshal(event Event) ([]byte, error) {
+	data, err := bson.Marshal(event)
+	if err != nil {
+		return nil, ErrCouldNotMarshalEvent
+	}
+	return data, nil
+}
+
+// Unmarshal implements EventCodec.
+func (c *BSONEventCodec) Unmarshal(data []byte, event Event) error {
+	raw := bson.Raw{Kind: 3, Data: data}
+	if err := raw.Unmarshal(event); err != nil {
+		return ErrCouldNotUnmarshalEvent
+	}
+	return nil
+}
+
+// ContentType implements EventCodec.
+func (c *BSONEventCodec) ContentType() string {
+	return "application/bson"
+}
+
+// JSONEventCodec marshals and unmarshals events as JSON, for consumers that
+// don't have a BSON library available.
+type JSONEventCodec struct{}
+
+// Marshal implements EventCodec.
+func (c *JSONEventCodec) Marshal(event Event) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, ErrCouldNotMarshalEvent
+	}
+	return data, nil
+}
+
+// Unmarshal implements EventCodec.
+func (c *JSONEventCodec) Unmarshal(data []byte, event Event) error {
+	if err := json.Unmarshal(data, event); err != nil {
+		return ErrCouldNotUnmarshalEvent
+	}
+	return nil
+}
+
+// ContentType implements EventCodec.
+func (c *JSONEventCodec) ContentType() string {
+	return "application/json"
+}
+
+// ProtobufEventCodec marshals and unmarshals events as Protocol Buffers.
+// The event passed to Marshal and Unmarshal must implement proto.Message.
+type ProtobufEventCodec struct{}
+
+// Marshal implements EventCodec. Returns ErrInvalidEvent if event does not
+// implement proto.Message.
+func (c *ProtobufEventCodec) Marshal(event Event) ([]byte, error) {
+	message, ok := event.(proto.Message)
+	if !ok {
+		return nil, ErrInvalidEvent
+	}
+
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return nil, ErrCouldNotMarshalEvent
+	}
+	return data, nil
+}
+
+// Unmarshal implements EventCodec. Returns ErrInvalidEvent if event does not
+// implement proto.Message.
+func (c *ProtobufEventCodec) Unmarshal(data []byte, event Event) error {
+	message, ok := event.(proto.Message)
+	if !ok {
+		return ErrInvalidEvent
+	}
+
+	if err := proto.Unmarshal(data, message); err != nil {
+		return ErrCouldNotUnmarshalEvent
+	}
+	return nil
+}
+
+// ContentType implements EventCodec.
+func (c *ProtobufEventCodec) ContentType() string {
+	return "application/protobuf"
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2016 - Max Persson <max@looplab.se>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventhorizon
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNoDeadLetterSink returned from Redrive when the bus has no
+// DeadLetterSink configured.
+var ErrNoDeadLetterSink = errors.New("no dead letter sink set")
+
+// ErrDeadLetterNotFound returned when a dead letter with a given id does
+// not exist in the sink.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// ErrCouldNotSaveDeadLetter returned when a dead letter could not be
+// persisted to the sink.
+var ErrCouldNotSaveDeadLetter = errors.New("could not save dead letter")
+
+// RetryPolicy configures how a bus retries a global handler that returned
+// an error, before giving up and routing the event to a DeadLetterSink.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times handling is attempted,
+	// including the first one.
+	MaxAttempts int
+
+	// Backoff returns how long to wait before the given retry attempt
+	// (0-indexed, so Backoff(0) is the wait before the second attempt).
+	Backoff func(attempt int) time.Duration
+}
+
+// DefaultRetryPolicy retries a failed handler twice more, waiting 100ms
+// then 200ms between attempts, before giving up.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 3,
+		Backoff: func(attempt int) time.Duration {
+			return time.Duration(1<<uint(attempt)) * 100 * time.Millisecond
+		},
+	}
+}
+
+// DeadLetter records an event that a bus failed to deliver to every global
+// handler after exhausting its RetryPolicy, or a received message that it
+// could not decode at all (stored with Attempts 0, without any retry), so
+// it can be inspected and later replayed with Redrive.
+type DeadLetter struct {
+	ID        UUID
+	Channel   string
+	Payload   []byte
+	Error     string
+	Attempts  int
+	Timestamp time.Time
+}
+
+// DeadLetterSink stores and retrieves dead letters for a bus.
+type DeadLetterSink interface {
+	// Send persists a dead letter for later inspection or replay.
+	Send(letter DeadLetter) error
+
+	// Get returns the dead letter stored under id.
+	Get(id UUID) (*DeadLetter, error)
+
+	// Remove deletes the dead letter stored under id, typically called
+	// after a successful Redrive.
+	Remove(id UUID) error
+}
+
+// dispatchWithRetry invokes every handler against event, retrying per policy
+// only the handlers that haven't yet succeeded, so a transient failure in
+// one handler doesn't redeliver the event to handlers that already
+// processed it. Returns the last error seen if any handler never succeeded.
+// A nil policy falls back to DefaultRetryPolicy.
+func dispatchWithRetry(handlers map[EventHandler]bool, event Event, policy *RetryPolicy) error {
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+
+	pending := make(map[EventHandler]bool, len(handlers))
+	for handler := range handlers {
+		pending[handler] = true
+	}
+
+	var err error
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		err = dispatchOnce(pending, event)
+		if len(pending) == 0 {
+			return nil
+		}
+		if attempt < policy.MaxAttempts-1 {
+			time.Sleep(policy.Backoff(attempt))
+		}
+	}
+
+	return err
+}
+
+// dispatchOnce invokes every handler still in pending, removing each one
+// that succeeds so a later retry only re-invokes the ones that failed.
+// Returns the last error seen, if any.
+func dispatchOnce(pending map[EventHandler]bool, event Event) error {
+	var err error
+	for handler := range pending {
+		if hErr := handler.HandleEvent(event); hErr != nil {
+			err = hErr
+			continue
+		}
+		delete(pending, handler)
+	}
+	return err
+}
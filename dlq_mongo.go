@@ -0,0 +1,106 @@
+// Copyright (c) 2016 - Max Persson <max@looplab.se>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build mongo
+
+package eventhorizon
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// MongoDeadLetterSink is a DeadLetterSink backed by a MongoDB collection.
+type MongoDeadLetterSink struct {
+	session *mgo.Session
+	db      string
+}
+
+// NewMongoDeadLetterSink creates a MongoDeadLetterSink using an existing
+// session.
+func NewMongoDeadLetterSink(session *mgo.Session, database string) (*MongoDeadLetterSink, error) {
+	if session == nil {
+		return nil, ErrNoDBSession
+	}
+
+	return &MongoDeadLetterSink{session: session, db: database}, nil
+}
+
+type mongoDeadLetterRecord struct {
+	ID        string    `bson:"_id"`
+	Channel   string    `bson:"channel"`
+	Payload   []byte    `bson:"payload"`
+	Error     string    `bson:"error"`
+	Attempts  int       `bson:"attempts"`
+	Timestamp time.Time `bson:"timestamp"`
+}
+
+// Send implements DeadLetterSink.
+func (s *MongoDeadLetterSink) Send(letter DeadLetter) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	record := mongoDeadLetterRecord{
+		ID:        letter.ID.String(),
+		Channel:   letter.Channel,
+		Payload:   letter.Payload,
+		Error:     letter.Error,
+		Attempts:  letter.Attempts,
+		Timestamp: letter.Timestamp,
+	}
+	if err := sess.DB(s.db).C("dead_letters").Insert(record); err != nil {
+		return ErrCouldNotSaveDeadLetter
+	}
+
+	return nil
+}
+
+// Get implements DeadLetterSink.
+func (s *MongoDeadLetterSink) Get(id UUID) (*DeadLetter, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	var record mongoDeadLetterRecord
+	err := sess.DB(s.db).C("dead_letters").FindId(id.String()).One(&record)
+	if err == mgo.ErrNotFound {
+		return nil, ErrDeadLetterNotFound
+	} else if err != nil {
+		return nil, ErrCouldNotLoadAggregate
+	}
+
+	return &DeadLetter{
+		ID:        id,
+		Channel:   record.Channel,
+		Payload:   record.Payload,
+		Error:     record.Error,
+		Attempts:  record.Attempts,
+		Timestamp: record.Timestamp,
+	}, nil
+}
+
+// Remove implements DeadLetterSink.
+func (s *MongoDeadLetterSink) Remove(id UUID) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	err := sess.DB(s.db).C("dead_letters").RemoveId(id.String())
+	if err == mgo.ErrNotFound {
+		return ErrDeadLetterNotFound
+	} else if err != nil {
+		return ErrCouldNotClearDB
+	}
+
+	return nil
+}
@@ -0,0 +1,351 @@
+// Copyright (c) 2016 - Max Persson <max@looplab.se>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build kafka
+
+package eventhorizon
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrCouldNotConnectToKafka returned when the event bus could not connect to
+// the Kafka brokers.
+var ErrCouldNotConnectToKafka = errors.New("could not connect to kafka")
+
+// KafkaEventBus is an event bus that publishes and subscribes to events
+// using Kafka. Every app gets its own topic, named after the app ID, and
+// events are keyed by aggregate ID so that all events for one aggregate
+// land on the same partition and are therefore delivered in order.
+//
+// Global handlers are invoked through a Kafka consumer group, so that
+// horizontally scaled instances of the same app share the partitions
+// between them instead of each instance receiving every event.
+type KafkaEventBus struct {
+	eventHandlers  map[string]map[EventHandler]bool
+	localHandlers  map[EventHandler]bool
+	globalHandlers map[EventHandler]bool
+	appID          string
+	topic          string
+	producer       sarama.SyncProducer
+	consumer       *cluster.Consumer
+	factories      map[string]func() Event
+	codec          EventCodec
+	done           chan bool
+	retryPolicy    *RetryPolicy
+	deadLetterSink DeadLetterSink
+}
+
+// NewKafkaEventBus creates a KafkaEventBus for remote events, using a
+// consumer group named after the appID so that multiple instances of the
+// same app share the topic's partitions rather than duplicating delivery.
+// If codec is nil, events are published as BSON-wrapped envelopes for
+// backwards compatibility.
+func NewKafkaEventBus(appID string, brokers []string, codec EventCodec) (*KafkaEventBus, error) {
+	config := cluster.NewConfig()
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Group.Return.Notifications = true
+
+	return NewKafkaEventBusWithConfig(appID, brokers, config, codec)
+}
+
+// NewKafkaEventBusWithConfig creates a KafkaEventBus for remote events with
+// a custom cluster config, for example to tune consumer group rebalancing
+// or offset commit behaviour. If codec is nil, events are published as
+// BSON-wrapped envelopes for backwards compatibility.
+func NewKafkaEventBusWithConfig(appID string, brokers []string, config *cluster.Config, codec EventCodec) (*KafkaEventBus, error) {
+	if codec == nil {
+		codec = &BSONEventCodec{}
+	}
+
+	producer, err := sarama.NewSyncProducer(brokers, nil)
+	if err != nil {
+		return nil, ErrCouldNotConnectToKafka
+	}
+
+	topic := appID + "-events"
+	consumer, err := cluster.NewConsumer(brokers, appID, []string{topic}, config)
+	if err != nil {
+		producer.Close()
+		return nil, ErrCouldNotConnectToKafka
+	}
+
+	b := &KafkaEventBus{
+		eventHandlers:  make(map[string]map[EventHandler]bool),
+		localHandlers:  make(map[EventHandler]bool),
+		globalHandlers: make(map[EventHandler]bool),
+		appID:          appID,
+		topic:          topic,
+		producer:       producer,
+		consumer:       consumer,
+		factories:      make(map[string]func() Event),
+		codec:          codec,
+		done:           make(chan bool),
+	}
+
+	go b.receiveGlobal()
+
+	return b, nil
+}
+
+// PublishEvent publishes an event to all handlers capable of handling it.
+func (b *KafkaEventBus) PublishEvent(event Event) {
+	if handlers, ok := b.eventHandlers[event.EventType()]; ok {
+		for handler := range handlers {
+			if err := handler.HandleEvent(event); err != nil {
+				log.Printf("error: event bus handle: %v\n", err)
+			}
+		}
+	}
+
+	// Publish to local handlers.
+	for handler := range b.localHandlers {
+		if err := handler.HandleEvent(event); err != nil {
+			log.Printf("error: event bus handle: %v\n", err)
+		}
+	}
+
+	// Publish to global handlers.
+	b.publishGlobal(event)
+}
+
+// AddHandler adds a handler for a specific local event.
+func (b *KafkaEventBus) AddHandler(handler EventHandler, event Event) {
+	// Create handler list for new event types.
+	if _, ok := b.eventHandlers[event.EventType()]; !ok {
+		b.eventHandlers[event.EventType()] = make(map[EventHandler]bool)
+	}
+
+	// Add handler to event type.
+	b.eventHandlers[event.EventType()][handler] = true
+}
+
+// AddLocalHandler adds a handler for local events.
+func (b *KafkaEventBus) AddLocalHandler(handler EventHandler) {
+	b.localHandlers[handler] = true
+}
+
+// AddGlobalHandler adds a handler for global (remote) events.
+func (b *KafkaEventBus) AddGlobalHandler(handler EventHandler) {
+	b.globalHandlers[handler] = true
+}
+
+// RegisterEventType registers an event factory for a event type. The factory is
+// used to create concrete event types when receiving from subscriptions.
+//
+// An example would be:
+//     eventStore.RegisterEventType(&MyEvent{}, func() Event { return &MyEvent{} })
+func (b *KafkaEventBus) RegisterEventType(event Event, factory func() Event) error {
+	if _, ok := b.factories[event.EventType()]; ok {
+		return ErrHandlerAlreadySet
+	}
+
+	b.factories[event.EventType()] = factory
+
+	return nil
+}
+
+// SetRetryPolicy sets the policy used to retry a failed global handler
+// before giving up on an event. If never set, DefaultRetryPolicy is used.
+func (b *KafkaEventBus) SetRetryPolicy(policy *RetryPolicy) {
+	b.retryPolicy = policy
+}
+
+// SetDeadLetterSink sets where events are routed once every retry attempt
+// at a global handler has failed. If unset, terminally failed events are
+// only logged, as before.
+func (b *KafkaEventBus) SetDeadLetterSink(sink DeadLetterSink) {
+	b.deadLetterSink = sink
+}
+
+// Redrive re-dispatches the dead letter stored under id to the global
+// handlers, and removes it from the sink on success.
+func (b *KafkaEventBus) Redrive(id UUID) error {
+	if b.deadLetterSink == nil {
+		return ErrNoDeadLetterSink
+	}
+
+	letter, err := b.deadLetterSink.Get(id)
+	if err != nil {
+		return err
+	}
+
+	event, err := b.decodeEnvelope(letter.Payload)
+	if err != nil {
+		return err
+	}
+
+	if err := dispatchWithRetry(b.globalHandlers, event, b.retryPolicy); err != nil {
+		return err
+	}
+
+	return b.deadLetterSink.Remove(id)
+}
+
+func (b *KafkaEventBus) deadLetter(eventType string, payload []byte, cause error, attempts int) {
+	if b.deadLetterSink == nil {
+		return
+	}
+
+	letter := DeadLetter{
+		ID:        NewUUID(),
+		Channel:   eventType,
+		Payload:   payload,
+		Error:     cause.Error(),
+		Attempts:  attempts,
+		Timestamp: time.Now(),
+	}
+	if err := b.deadLetterSink.Send(letter); err != nil {
+		log.Printf("error: event bus dead letter: %v\n", err)
+	}
+}
+
+// Close exits the receive goroutine and closes the consumer and producer.
+func (b *KafkaEventBus) Close() {
+	close(b.done)
+
+	if err := b.consumer.Close(); err != nil {
+		log.Printf("error: event bus close consumer: %v\n", err)
+	}
+	if err := b.producer.Close(); err != nil {
+		log.Printf("error: event bus close producer: %v\n", err)
+	}
+}
+
+func (b *KafkaEventBus) publishGlobal(event Event) {
+	// Wrap the codec-encoded event in the same envelope RedisEventBus uses,
+	// so a consumer reading either bus negotiates content type the same way.
+	payload, err := b.codec.Marshal(event)
+	if err != nil {
+		log.Printf("error: event bus publish: %v\n", err)
+		return
+	}
+	envelope := &EventEnvelope{
+		Type:        event.EventType(),
+		Timestamp:   time.Now(),
+		AggregateID: event.AggregateID().String(),
+		ContentType: b.codec.ContentType(),
+		Payload:     payload,
+	}
+
+	data, err := bson.Marshal(envelope)
+	if err != nil {
+		log.Printf("error: event bus publish: %v\n", ErrCouldNotMarshalEnvelope)
+		return
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: b.topic,
+		Key:   sarama.StringEncoder(event.AggregateID().String()),
+		Value: sarama.ByteEncoder(data),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("type"), Value: []byte(event.EventType())},
+		},
+	}
+
+	if _, _, err := b.producer.SendMessage(msg); err != nil {
+		log.Printf("error: event bus publish: %v\n", err)
+	}
+}
+
+// receiveGlobal starts the receive loop for the consumer group. Offsets are
+// only committed once the event has been dispatched to every global
+// handler, giving at-least-once delivery: a crash between receive and
+// dispatch simply redelivers the event on restart.
+func (b *KafkaEventBus) receiveGlobal() {
+	for {
+		select {
+		case msg, ok := <-b.consumer.Messages():
+			if !ok {
+				return
+			}
+
+			eventType := headerEventType(msg.Headers)
+			event, err := b.decodeEnvelope(msg.Value)
+			if err != nil {
+				log.Printf("error: event bus receive: %v\n", err)
+				b.deadLetter(eventType, msg.Value, err, 0)
+				b.consumer.MarkOffset(msg, "")
+				continue
+			}
+
+			if err := dispatchWithRetry(b.globalHandlers, event, b.retryPolicy); err != nil {
+				log.Printf("error: event bus receive: %v\n", err)
+				policy := b.retryPolicy
+				if policy == nil {
+					policy = DefaultRetryPolicy()
+				}
+				b.deadLetter(eventType, msg.Value, err, policy.MaxAttempts)
+			}
+
+			// Commit the offset only after every handler has run (or the
+			// event has been routed to the dead letter sink).
+			b.consumer.MarkOffset(msg, "")
+		case err, ok := <-b.consumer.Errors():
+			if !ok {
+				return
+			}
+			log.Printf("error: event bus receive: %v\n", err)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// headerEventType extracts the event type carried on a message's "type"
+// header, set by publishGlobal. Used only to label a message that can't be
+// decoded (for example for a dead letter); decoding itself reads the type
+// off the envelope, whereas RedisEventBus takes it from the channel name.
+func headerEventType(headers []*sarama.RecordHeader) string {
+	for _, h := range headers {
+		if string(h.Key) == "type" {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// decodeEnvelope decodes a received message into its envelope, then decodes
+// the envelope's payload with whichever codec the publisher named in it.
+func (b *KafkaEventBus) decodeEnvelope(data []byte) (Event, error) {
+	var envelope EventEnvelope
+	raw := bson.Raw{Kind: 3, Data: data}
+	if err := raw.Unmarshal(&envelope); err != nil {
+		return nil, ErrCouldNotUnmarshalEnvelope
+	}
+
+	f, ok := b.factories[envelope.Type]
+	if !ok {
+		return nil, ErrEventNotRegistered
+	}
+
+	codec, err := codecByContentType(envelope.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	event := f()
+	if err := codec.Unmarshal(envelope.Payload, event); err != nil {
+		return nil, ErrCouldNotUnmarshalEvent
+	}
+
+	return event, nil
+}
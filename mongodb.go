@@ -54,16 +54,25 @@ var ErrCouldNotSaveAggregate = errors.New("could not save aggregate")
 // ErrInvalidEvent returned when an event does not implement the Event interface.
 var ErrInvalidEvent = errors.New("invalid event")
 
+// ErrConcurrencyConflict returned from Save when the aggregate's version no
+// longer matches the expected version passed by the caller, meaning another
+// writer appended events in between the caller's Load and Save.
+var ErrConcurrencyConflict = errors.New("concurrency conflict")
+
 // MongoEventStore implements an EventStore for MongoDB.
 type MongoEventStore struct {
-	eventBus  EventBus
-	session   *mgo.Session
-	db        string
-	factories map[string]func() Event
+	eventBus       EventBus
+	session        *mgo.Session
+	db             string
+	factories      map[string]func() Event
+	codec          EventCodec
+	wMode          string
+	snapshotPolicy SnapshotPolicy
 }
 
-// NewMongoEventStore creates a new MongoEventStore.
-func NewMongoEventStore(eventBus EventBus, url, database string) (*MongoEventStore, error) {
+// NewMongoEventStore creates a new MongoEventStore. If codec is nil, events
+// are stored as BSON for backwards compatibility.
+func NewMongoEventStore(eventBus EventBus, url, database string, codec EventCodec) (*MongoEventStore, error) {
 	session, err := mgo.Dial(url)
 	if err != nil {
 		return nil, ErrCouldNotDialDB
@@ -72,20 +81,27 @@ func NewMongoEventStore(eventBus EventBus, url, database string) (*MongoEventSto
 	session.SetMode(mgo.Strong, true)
 	session.SetSafe(&mgo.Safe{W: 1})
 
-	return NewMongoEventStoreWithSession(eventBus, session, database)
+	return NewMongoEventStoreWithSession(eventBus, session, database, codec)
 }
 
-// NewMongoEventStoreWithSession creates a new MongoEventStore with a session.
-func NewMongoEventStoreWithSession(eventBus EventBus, session *mgo.Session, database string) (*MongoEventStore, error) {
+// NewMongoEventStoreWithSession creates a new MongoEventStore with a
+// session. If codec is nil, events are stored as BSON for backwards
+// compatibility.
+func NewMongoEventStoreWithSession(eventBus EventBus, session *mgo.Session, database string, codec EventCodec) (*MongoEventStore, error) {
 	if session == nil {
 		return nil, ErrNoDBSession
 	}
 
+	if codec == nil {
+		codec = &BSONEventCodec{}
+	}
+
 	s := &MongoEventStore{
 		eventBus:  eventBus,
 		factories: make(map[string]func() Event),
 		session:   session,
 		db:        database,
+		codec:     codec,
 	}
 
 	return s, nil
@@ -96,97 +112,235 @@ type mongoAggregateRecord struct {
 	Version     int                 `bson:"version"`
 	Events      []*mongoEventRecord `bson:"events"`
 	// Type        string        `bson:"type"`
-	// Snapshot    bson.Raw      `bson:"snapshot"`
 }
 
 type mongoEventRecord struct {
-	Type      string    `bson:"type"`
-	Version   int       `bson:"version"`
-	Timestamp time.Time `bson:"timestamp"`
-	Event     Event     `bson:"-"`
-	Data      bson.Raw  `bson:"data"`
+	Type        string    `bson:"type"`
+	Version     int       `bson:"version"`
+	Position    Position  `bson:"position"`
+	Timestamp   time.Time `bson:"timestamp"`
+	ContentType string    `bson:"content_type"`
+	Event       Event     `bson:"-"`
+	Data        []byte    `bson:"data"`
+}
+
+// mongoSnapshotRecord is stored in a separate "snapshots" collection, keyed
+// by (aggregate_id, version), so old snapshots can be pruned independently
+// of the event history.
+type mongoSnapshotRecord struct {
+	AggregateID string    `bson:"aggregate_id"`
+	Version     int       `bson:"version"`
+	Timestamp   time.Time `bson:"timestamp"`
+	Data        []byte    `bson:"data"`
 }
 
-// Save appends all events in the event stream to the database.
-func (s *MongoEventStore) Save(events []Event) error {
+// Save appends all events in the event stream to the database in a single
+// write, conditional on the aggregate's current version matching
+// expectedVersion (the version the caller's events were loaded at). Returns
+// ErrConcurrencyConflict if another writer appended events first, so the
+// caller can reload and retry.
+//
+// For a brand new aggregate (expectedVersion == 0) this inserts a new
+// aggregate document; for an existing one it performs one conditional
+// $push/$inc, matching on "version == expectedVersion", so the whole batch
+// is appended atomically instead of leaving some events persisted and
+// published while a later one in the batch conflicts.
+//
+// If snapshotter is non-nil and a snapshot policy has been registered with
+// SetSnapshotPolicy, a new snapshot is taken once the policy decides it is
+// due.
+func (s *MongoEventStore) Save(events []Event, expectedVersion int, snapshotter Snapshotter) error {
 	if len(events) == 0 {
 		return ErrNoEventsToAppend
 	}
 
 	sess := s.session.Copy()
 	defer sess.Close()
+	if s.wMode != "" {
+		sess.EnsureSafe(&mgo.Safe{WMode: s.wMode})
+	}
 
-	for _, event := range events {
-		// Get an existing aggregate, if any.
-		var existing []mongoAggregateRecord
-		err := sess.DB(s.db).C("events").FindId(event.AggregateID().String()).
-			Select(bson.M{"version": 1}).Limit(1).All(&existing)
-		if err != nil || len(existing) > 1 {
-			return ErrCouldNotLoadAggregate
-		}
-
-		// Marshal event data.
-		var data []byte
-		if data, err = bson.Marshal(event); err != nil {
+	// Positions are allocated after the write below succeeds (see
+	// assignPositions), not here: a conflict is the expected, routine
+	// outcome of optimistic locking, and pre-allocating a position for an
+	// event that never gets written would burn it, leaving a gap catch-up
+	// subscriptions can never fill.
+	records := make([]*mongoEventRecord, len(events))
+	for i, event := range events {
+		data, err := s.codec.Marshal(event)
+		if err != nil {
 			return ErrCouldNotMarshalEvent
 		}
 
-		// Create the event record with timestamp.
-		r := &mongoEventRecord{
-			Type:      event.EventType(),
-			Version:   1,
-			Timestamp: time.Now(),
-			Data:      bson.Raw{3, data},
+		records[i] = &mongoEventRecord{
+			Type:        event.EventType(),
+			Version:     expectedVersion + i + 1,
+			Timestamp:   time.Now(),
+			ContentType: s.codec.ContentType(),
+			Data:        data,
 		}
+	}
 
-		// Either insert a new aggregate or append to an existing.
-		if len(existing) == 0 {
-			aggregate := mongoAggregateRecord{
-				AggregateID: event.AggregateID().String(),
-				Version:     1,
-				Events:      []*mongoEventRecord{r},
-			}
+	aggregateID := events[0].AggregateID().String()
+	newVersion := expectedVersion + len(events)
 
-			if err := sess.DB(s.db).C("events").Insert(aggregate); err != nil {
-				return ErrCouldNotSaveAggregate
-			}
-		} else {
-			// Increment record version before inserting.
-			r.Version = existing[0].Version + 1
-
-			// Increment aggregate version on insert of new event record, and
-			// only insert if version of aggregate is matching (ie not changed
-			// since the query above).
-			err = sess.DB(s.db).C("events").Update(
-				bson.M{
-					"_id":     event.AggregateID().String(),
-					"version": existing[0].Version,
-				},
-				bson.M{
-					"$push": bson.M{"events": r},
-					"$inc":  bson.M{"version": 1},
-				},
-			)
-			if err != nil {
-				return ErrCouldNotSaveAggregate
+	if expectedVersion == 0 {
+		aggregate := &mongoAggregateRecord{
+			AggregateID: aggregateID,
+			Version:     newVersion,
+			Events:      records,
+		}
+		if err := sess.DB(s.db).C("events").Insert(aggregate); err != nil {
+			if mgo.IsDup(err) {
+				// Another writer already created this aggregate.
+				return ErrConcurrencyConflict
 			}
+			return ErrCouldNotSaveAggregate
+		}
+	} else {
+		// Append every event and bump the aggregate version in one
+		// conditional write, so a conflict either appends the whole batch
+		// or none of it.
+		err := sess.DB(s.db).C("events").Update(
+			bson.M{
+				"_id":     aggregateID,
+				"version": expectedVersion,
+			},
+			bson.M{
+				"$push": bson.M{"events": bson.M{"$each": records}},
+				"$inc":  bson.M{"version": len(events)},
+			},
+		)
+		if err == mgo.ErrNotFound {
+			// No document matched both _id and the expected version.
+			return ErrConcurrencyConflict
+		} else if err != nil {
+			return ErrCouldNotSaveAggregate
 		}
+	}
+
+	// Only allocate global positions once the append above is durably
+	// acknowledged, so a conflicting or otherwise failed save never
+	// consumes one.
+	if err := s.assignPositions(sess, aggregateID, records); err != nil {
+		return err
+	}
 
-		// Publish event on the bus.
-		if s.eventBus != nil {
+	// Publish events on the bus, now that the write is durably acknowledged
+	// per the configured write concern.
+	if s.eventBus != nil {
+		for _, event := range events {
 			s.eventBus.PublishEvent(event)
 		}
 	}
 
+	if s.snapshotPolicy != nil && snapshotter != nil {
+		if err := s.maybeSnapshot(sess, events[0].AggregateID(), newVersion, snapshotter); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// Load loads all events for the aggregate id from the database.
-// Returns nil if no events can be found.
-func (s *MongoEventStore) Load(id UUID) ([]Event, error) {
+// maybeSnapshot takes and stores a snapshot for aggregateID at newVersion if
+// the registered snapshot policy decides one is due.
+func (s *MongoEventStore) maybeSnapshot(sess *mgo.Session, id UUID, newVersion int, snapshotter Snapshotter) error {
+	var last mongoSnapshotRecord
+	err := sess.DB(s.db).C("snapshots").Find(bson.M{"aggregate_id": id.String()}).
+		Sort("-version").One(&last)
+	if err != nil && err != mgo.ErrNotFound {
+		return ErrCouldNotLoadAggregate
+	}
+
+	if !s.snapshotPolicy.ShouldSnapshot(last.Version, newVersion, last.Timestamp) {
+		return nil
+	}
+
+	data, err := snapshotter.TakeSnapshot()
+	if err != nil {
+		return ErrCouldNotMarshalEvent
+	}
+
+	snapshot := mongoSnapshotRecord{
+		AggregateID: id.String(),
+		Version:     newVersion,
+		Timestamp:   time.Now(),
+		Data:        data,
+	}
+	if err := sess.DB(s.db).C("snapshots").Insert(snapshot); err != nil {
+		return ErrCouldNotSaveAggregate
+	}
+
+	return nil
+}
+
+// SetWriteConcern sets the write concern mode (for example "majority") used
+// when saving events. The default is equivalent to mgo's W: 1.
+func (s *MongoEventStore) SetWriteConcern(wMode string) {
+	s.wMode = wMode
+}
+
+// SetSnapshotPolicy registers the policy used to decide when Save should
+// take a new snapshot. If no policy is set, Save never snapshots even when
+// given a Snapshotter.
+func (s *MongoEventStore) SetSnapshotPolicy(policy SnapshotPolicy) {
+	s.snapshotPolicy = policy
+}
+
+// PruneSnapshots removes all snapshots for id older than the latest one,
+// since only the most recent snapshot is ever read by Load.
+func (s *MongoEventStore) PruneSnapshots(id UUID) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	var last mongoSnapshotRecord
+	err := sess.DB(s.db).C("snapshots").Find(bson.M{"aggregate_id": id.String()}).
+		Sort("-version").One(&last)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return ErrCouldNotLoadAggregate
+	}
+
+	_, err = sess.DB(s.db).C("snapshots").RemoveAll(bson.M{
+		"aggregate_id": id.String(),
+		"version":      bson.M{"$lt": last.Version},
+	})
+	if err != nil {
+		return ErrCouldNotClearDB
+	}
+
+	return nil
+}
+
+// Load loads events for the aggregate id from the database. Returns nil if
+// no events can be found.
+//
+// If snapshotter is non-nil and a snapshot exists, ApplySnapshot is called
+// on it first and only the events after the snapshot's version are
+// returned, so the caller replays just the tail instead of the full
+// history.
+func (s *MongoEventStore) Load(id UUID, snapshotter Snapshotter) ([]Event, error) {
 	sess := s.session.Copy()
 	defer sess.Close()
 
+	fromVersion := 0
+	if snapshotter != nil {
+		var snapshot mongoSnapshotRecord
+		err := sess.DB(s.db).C("snapshots").Find(bson.M{"aggregate_id": id.String()}).
+			Sort("-version").One(&snapshot)
+		if err != nil && err != mgo.ErrNotFound {
+			return nil, ErrCouldNotLoadAggregate
+		}
+		if err == nil {
+			if err := snapshotter.ApplySnapshot(snapshot.Data); err != nil {
+				return nil, ErrCouldNotUnmarshalEvent
+			}
+			fromVersion = snapshot.Version
+		}
+	}
+
 	var aggregates []mongoAggregateRecord
 	err := sess.DB(s.db).C("events").FindId(id.String()).Limit(1).All(&aggregates)
 	if err != nil || len(aggregates) > 1 {
@@ -196,26 +350,21 @@ func (s *MongoEventStore) Load(id UUID) ([]Event, error) {
 	}
 
 	aggregate := aggregates[0]
-	events := make([]Event, len(aggregate.Events))
-	for i, record := range aggregate.Events {
-		// Get the registered factory function for creating events.
-		f, ok := s.factories[record.Type]
-		if !ok {
-			return nil, ErrEventNotRegistered
+	events := make([]Event, 0, len(aggregate.Events))
+	for _, record := range aggregate.Events {
+		if record.Version <= fromVersion {
+			continue
 		}
 
-		// Manually decode the raw BSON event.
-		event := f()
-		if err := record.Data.Unmarshal(event); err != nil {
-			return nil, ErrCouldNotUnmarshalEvent
-		}
-		if events[i], ok = event.(Event); !ok {
-			return nil, ErrInvalidEvent
+		decoded, err := s.decodeRecord(record)
+		if err != nil {
+			return nil, err
 		}
 
 		// Set concrete event and zero out the decoded event.
-		record.Event = events[i]
-		record.Data = bson.Raw{}
+		record.Event = decoded
+		record.Data = nil
+		events = append(events, decoded)
 	}
 
 	return events, nil
@@ -0,0 +1,193 @@
+// Copyright (c) 2016 - Max Persson <max@looplab.se>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build mongo
+
+package eventhorizon
+
+import "gopkg.in/mgo.v2/bson"
+
+// FindPaged returns a page of read models matching filter, sorted by sort
+// (prefix a field with "-" for descending, as in mgo's own Sort), skipping
+// skip and returning at most limit of them. total is the number of models
+// matching filter ignoring skip and limit, so callers can compute the
+// total number of pages. A limit of 0 returns every remaining model.
+func (r *MongoReadRepository) FindPaged(filter bson.M, sort []string, skip, limit int) (results []interface{}, total int64, err error) {
+	if r.factory == nil {
+		return nil, 0, ErrModelNotSet
+	}
+
+	sess := r.session.Copy()
+	defer sess.Close()
+
+	query := sess.DB(r.db).C(r.collection).Find(filter)
+
+	count, err := query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(sort) > 0 {
+		query = query.Sort(sort...)
+	}
+	if skip > 0 {
+		query = query.Skip(skip)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	iter := query.Iter()
+	results = []interface{}{}
+	model := r.factory()
+	for iter.Next(model) {
+		results = append(results, model)
+		model = r.factory()
+	}
+	if err := iter.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	return results, int64(count), nil
+}
+
+// Query builds a filtered, sorted, paginated, field-limited read against a
+// MongoReadRepository, without the caller needing to import mgo or receive
+// a *mgo.Collection through a callback the way FindCustom does.
+type Query struct {
+	repo     *MongoReadRepository
+	filter   bson.M
+	sortBy   []string
+	skipN    int
+	limitN   int
+	selected bson.M
+}
+
+// Query starts a fluent query against the repository.
+func (r *MongoReadRepository) Query() *Query {
+	return &Query{repo: r, filter: bson.M{}}
+}
+
+// Where merges fields into the query's filter.
+func (q *Query) Where(filter bson.M) *Query {
+	for k, v := range filter {
+		q.filter[k] = v
+	}
+	return q
+}
+
+// OrderBy sets the sort order; prefix a field with "-" for descending, as
+// in mgo's own Sort.
+func (q *Query) OrderBy(fields ...string) *Query {
+	q.sortBy = fields
+	return q
+}
+
+// Skip sets how many matching models to skip before returning results.
+func (q *Query) Skip(n int) *Query {
+	q.skipN = n
+	return q
+}
+
+// Limit caps how many models All returns. 0 (the default) returns every
+// remaining match.
+func (q *Query) Limit(n int) *Query {
+	q.limitN = n
+	return q
+}
+
+// Select restricts which fields are populated on the returned models.
+func (q *Query) Select(fields bson.M) *Query {
+	q.selected = fields
+	return q
+}
+
+// All runs the query and returns the matching models along with total, the
+// count matching Where ignoring Skip and Limit, so callers can compute the
+// total number of pages.
+func (q *Query) All() (results []interface{}, total int64, err error) {
+	if q.repo.factory == nil {
+		return nil, 0, ErrModelNotSet
+	}
+
+	sess := q.repo.session.Copy()
+	defer sess.Close()
+
+	collection := sess.DB(q.repo.db).C(q.repo.collection)
+
+	count, err := collection.Find(q.filter).Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := collection.Find(q.filter)
+	if q.selected != nil {
+		query = query.Select(q.selected)
+	}
+	if len(q.sortBy) > 0 {
+		query = query.Sort(q.sortBy...)
+	}
+	if q.skipN > 0 {
+		query = query.Skip(q.skipN)
+	}
+	if q.limitN > 0 {
+		query = query.Limit(q.limitN)
+	}
+
+	iter := query.Iter()
+	results = []interface{}{}
+	model := q.repo.factory()
+	for iter.Next(model) {
+		results = append(results, model)
+		model = q.repo.factory()
+	}
+	if err := iter.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	return results, int64(count), nil
+}
+
+// FindAllStream streams every read model in the repository over a channel
+// instead of materializing them all in memory first, for collections too
+// large for FindAll. results is closed once every model has been sent or
+// an error occurs; an error is sent on errs before results is closed.
+func (r *MongoReadRepository) FindAllStream() (results <-chan interface{}, errs <-chan error) {
+	resultsChan := make(chan interface{})
+	errsChan := make(chan error, 1)
+
+	go func() {
+		defer close(resultsChan)
+
+		if r.factory == nil {
+			errsChan <- ErrModelNotSet
+			return
+		}
+
+		sess := r.session.Copy()
+		defer sess.Close()
+
+		iter := sess.DB(r.db).C(r.collection).Find(nil).Iter()
+		model := r.factory()
+		for iter.Next(model) {
+			resultsChan <- model
+			model = r.factory()
+		}
+		if err := iter.Close(); err != nil {
+			errsChan <- err
+		}
+	}()
+
+	return resultsChan, errsChan
+}
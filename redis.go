@@ -35,10 +35,14 @@ type RedisEventBus struct {
 	pool           *redis.Pool
 	conn           *redis.PubSubConn
 	factories      map[string]func() Event
+	codec          EventCodec
+	retryPolicy    *RetryPolicy
+	deadLetterSink DeadLetterSink
 }
 
-// NewRedisEventBus creates a RedisEventBus for remote events.
-func NewRedisEventBus(appID, server, password string) (*RedisEventBus, error) {
+// NewRedisEventBus creates a RedisEventBus for remote events. If codec is
+// nil, events are published as BSON for backwards compatibility.
+func NewRedisEventBus(appID, server, password string, codec EventCodec) (*RedisEventBus, error) {
 	pool := &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
@@ -61,11 +65,16 @@ func NewRedisEventBus(appID, server, password string) (*RedisEventBus, error) {
 		},
 	}
 
-	return NewRedisEventBusWithPool(appID, pool)
+	return NewRedisEventBusWithPool(appID, pool, codec)
 }
 
-// NewRedisEventBusWithPool creates a RedisEventBus for remote events.
-func NewRedisEventBusWithPool(appID string, pool *redis.Pool) (*RedisEventBus, error) {
+// NewRedisEventBusWithPool creates a RedisEventBus for remote events. If
+// codec is nil, events are published as BSON for backwards compatibility.
+func NewRedisEventBusWithPool(appID string, pool *redis.Pool, codec EventCodec) (*RedisEventBus, error) {
+	if codec == nil {
+		codec = &BSONEventCodec{}
+	}
+
 	b := &RedisEventBus{
 		eventHandlers:  make(map[string]map[EventHandler]bool),
 		localHandlers:  make(map[EventHandler]bool),
@@ -73,6 +82,7 @@ func NewRedisEventBusWithPool(appID string, pool *redis.Pool) (*RedisEventBus, e
 		prefix:         appID + ":events:",
 		pool:           pool,
 		factories:      make(map[string]func() Event),
+		codec:          codec,
 	}
 
 	ready := make(chan error)
@@ -90,13 +100,17 @@ func NewRedisEventBusWithPool(appID string, pool *redis.Pool) (*RedisEventBus, e
 func (b *RedisEventBus) PublishEvent(event Event) {
 	if handlers, ok := b.eventHandlers[event.EventType()]; ok {
 		for handler := range handlers {
-			handler.HandleEvent(event)
+			if err := handler.HandleEvent(event); err != nil {
+				log.Printf("error: event bus handle: %v\n", err)
+			}
 		}
 	}
 
 	// Publish to local handlers.
 	for handler := range b.localHandlers {
-		handler.HandleEvent(event)
+		if err := handler.HandleEvent(event); err != nil {
+			log.Printf("error: event bus handle: %v\n", err)
+		}
 	}
 
 	// Publish to global handlers.
@@ -140,6 +154,61 @@ func (b *RedisEventBus) RegisterEventType(event Event, factory func() Event) err
 	return nil
 }
 
+// SetRetryPolicy sets the policy used to retry a failed global handler
+// before giving up on an event. If never set, DefaultRetryPolicy is used.
+func (b *RedisEventBus) SetRetryPolicy(policy *RetryPolicy) {
+	b.retryPolicy = policy
+}
+
+// SetDeadLetterSink sets where events are routed once every retry attempt
+// at a global handler has failed. If unset, terminally failed events are
+// only logged, as before.
+func (b *RedisEventBus) SetDeadLetterSink(sink DeadLetterSink) {
+	b.deadLetterSink = sink
+}
+
+// Redrive re-dispatches the dead letter stored under id to the global
+// handlers, and removes it from the sink on success.
+func (b *RedisEventBus) Redrive(id UUID) error {
+	if b.deadLetterSink == nil {
+		return ErrNoDeadLetterSink
+	}
+
+	letter, err := b.deadLetterSink.Get(id)
+	if err != nil {
+		return err
+	}
+
+	event, err := b.decodeEnvelope(strings.TrimPrefix(letter.Channel, b.prefix), letter.Payload)
+	if err != nil {
+		return err
+	}
+
+	if err := dispatchWithRetry(b.globalHandlers, event, b.retryPolicy); err != nil {
+		return err
+	}
+
+	return b.deadLetterSink.Remove(id)
+}
+
+func (b *RedisEventBus) deadLetter(channel string, payload []byte, cause error, attempts int) {
+	if b.deadLetterSink == nil {
+		return
+	}
+
+	letter := DeadLetter{
+		ID:        NewUUID(),
+		Channel:   channel,
+		Payload:   payload,
+		Error:     cause.Error(),
+		Attempts:  attempts,
+		Timestamp: time.Now(),
+	}
+	if err := b.deadLetterSink.Send(letter); err != nil {
+		log.Printf("error: event bus dead letter: %v\n", err)
+	}
+}
+
 // Close exits the receive goroutine by unsubscribing to all channels.
 func (b *RedisEventBus) Close() {
 	err := b.conn.PUnsubscribe()
@@ -155,11 +224,25 @@ func (b *RedisEventBus) publishGlobal(event Event) {
 		log.Printf("error: event bus publish: %v\n", err)
 	}
 
-	// Marshal event data.
+	// Wrap the codec-encoded event in an envelope that carries enough
+	// metadata for a consumer to pick a matching codec on receive.
+	payload, err := b.codec.Marshal(event)
+	if err != nil {
+		log.Printf("error: event bus publish: %v\n", err)
+		return
+	}
+	envelope := &EventEnvelope{
+		Type:        event.EventType(),
+		Timestamp:   time.Now(),
+		AggregateID: event.AggregateID().String(),
+		ContentType: b.codec.ContentType(),
+		Payload:     payload,
+	}
+
 	var data []byte
-	var err error
-	if data, err = bson.Marshal(event); err != nil {
-		log.Printf("error: event bus publish: %v\n", ErrCouldNotMarshalEvent)
+	if data, err = bson.Marshal(envelope); err != nil {
+		log.Printf("error: event bus publish: %v\n", ErrCouldNotMarshalEnvelope)
+		return
 	}
 
 	// Publish all events on their own channel.
@@ -168,6 +251,33 @@ func (b *RedisEventBus) publishGlobal(event Event) {
 	}
 }
 
+// decodeEnvelope decodes a received message into its envelope, then decodes
+// the envelope's payload with whichever codec the publisher named in it.
+func (b *RedisEventBus) decodeEnvelope(eventType string, data []byte) (Event, error) {
+	f, ok := b.factories[eventType]
+	if !ok {
+		return nil, ErrEventNotRegistered
+	}
+
+	var envelope EventEnvelope
+	raw := bson.Raw{Kind: 3, Data: data}
+	if err := raw.Unmarshal(&envelope); err != nil {
+		return nil, ErrCouldNotUnmarshalEnvelope
+	}
+
+	codec, err := codecByContentType(envelope.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	event := f()
+	if err := codec.Unmarshal(envelope.Payload, event); err != nil {
+		return nil, ErrCouldNotUnmarshalEvent
+	}
+
+	return event, nil
+}
+
 // connectAndSubscribe connects to event bus and subscribes to events. Will retry on event bus connection failure.
 func (b *RedisEventBus) connectAndSubscribe(ready chan error) {
 	isRetry := false
@@ -225,26 +335,22 @@ func (b *RedisEventBus) receiveGlobal(done chan bool) {
 	for {
 		switch n := b.conn.Receive().(type) {
 		case redis.PMessage:
-			// Extract the event type from the channel name.
 			eventType := strings.TrimPrefix(n.Channel, b.prefix)
 
-			// Get the registered factory function for creating events.
-			f, ok := b.factories[eventType]
-			if !ok {
-				log.Printf("error: event bus receive: %v\n", ErrEventNotRegistered)
-				continue
-			}
-
-			// Manually decode the raw BSON event.
-			data := bson.Raw{Kind: 3, Data: n.Data}
-			event := f()
-			if err := data.Unmarshal(event); err != nil {
-				log.Printf("error: event bus receive: %v\n", ErrCouldNotUnmarshalEvent)
+			event, err := b.decodeEnvelope(eventType, n.Data)
+			if err != nil {
+				log.Printf("error: event bus receive: %v\n", err)
+				b.deadLetter(n.Channel, n.Data, err, 0)
 				continue
 			}
 
-			for handler := range b.globalHandlers {
-				handler.HandleEvent(event)
+			if err := dispatchWithRetry(b.globalHandlers, event, b.retryPolicy); err != nil {
+				log.Printf("error: event bus receive: %v\n", err)
+				policy := b.retryPolicy
+				if policy == nil {
+					policy = DefaultRetryPolicy()
+				}
+				b.deadLetter(n.Channel, n.Data, err, policy.MaxAttempts)
 			}
 		case redis.Subscription:
 			switch n.Kind {
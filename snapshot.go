@@ -0,0 +1,62 @@
+// Copyright (c) 2016 - Max Persson <max@looplab.se>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventhorizon
+
+import "time"
+
+// Snapshotter is implemented by an aggregate (or a wrapper around one) that
+// can save and restore its own state outside of the event history, so a
+// store can avoid replaying every event from the beginning to load a
+// long-lived aggregate.
+type Snapshotter interface {
+	// TakeSnapshot encodes the current state into bytes to be persisted.
+	TakeSnapshot() ([]byte, error)
+
+	// ApplySnapshot restores state from a previously taken snapshot. After
+	// this call, only events after the snapshot's version still need to be
+	// replayed.
+	ApplySnapshot(data []byte) error
+}
+
+// SnapshotPolicy decides whether a new snapshot should be taken after
+// events have been appended to an aggregate.
+type SnapshotPolicy interface {
+	// ShouldSnapshot reports whether a snapshot should be taken now, given
+	// the version of the last snapshot (0 if none exists), the aggregate's
+	// new version, and when the last snapshot was taken.
+	ShouldSnapshot(lastSnapshotVersion, newVersion int, lastSnapshotAt time.Time) bool
+}
+
+// SnapshotEveryNEvents snapshots once at least N events have been appended
+// since the last snapshot.
+type SnapshotEveryNEvents struct {
+	N int
+}
+
+// ShouldSnapshot implements SnapshotPolicy.
+func (p *SnapshotEveryNEvents) ShouldSnapshot(lastSnapshotVersion, newVersion int, lastSnapshotAt time.Time) bool {
+	return newVersion-lastSnapshotVersion >= p.N
+}
+
+// SnapshotEveryInterval snapshots once at least Interval has elapsed since
+// the last snapshot.
+type SnapshotEveryInterval struct {
+	Interval time.Duration
+}
+
+// ShouldSnapshot implements SnapshotPolicy.
+func (p *SnapshotEveryInterval) ShouldSnapshot(lastSnapshotVersion, newVersion int, lastSnapshotAt time.Time) bool {
+	return time.Since(lastSnapshotAt) >= p.Interval
+}